@@ -0,0 +1,67 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testInputs() (masterKey, salt, info, header, nonce1, nonce2, plaintext []byte) {
+	masterKey = bytes.Repeat([]byte{0x42}, 32)
+	salt = bytes.Repeat([]byte{0x24}, 16)
+	info = []byte("sec-vault-cascade-v1")
+	header = []byte("SEC1-test-header")
+	nonce1 = bytes.Repeat([]byte{0x01}, ChaChaNonceSize)
+	nonce2 = bytes.Repeat([]byte{0x02}, SerpentNonceSize)
+	plaintext = []byte(`{"hello":"world"}`)
+	return
+}
+
+func TestSealOpenRoundTrip(t *testing.T) {
+	masterKey, salt, info, header, nonce1, nonce2, plaintext := testInputs()
+
+	sealed, err := Seal(masterKey, salt, info, header, nonce1, nonce2, plaintext)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	got, err := Open(masterKey, salt, info, header, nonce1, nonce2, sealed)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Fatalf("round trip mismatch: got %q want %q", got, plaintext)
+	}
+}
+
+func TestOpenRejectsTamperedSealedBytes(t *testing.T) {
+	masterKey, salt, info, header, nonce1, nonce2, plaintext := testInputs()
+
+	sealed, err := Seal(masterKey, salt, info, header, nonce1, nonce2, plaintext)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	for i := range sealed {
+		tampered := append([]byte{}, sealed...)
+		tampered[i] ^= 0x01
+		if _, err := Open(masterKey, salt, info, header, nonce1, nonce2, tampered); err == nil {
+			t.Fatalf("Open accepted tampered byte at offset %d", i)
+		}
+	}
+}
+
+func TestOpenRejectsTamperedHeader(t *testing.T) {
+	masterKey, salt, info, header, nonce1, nonce2, plaintext := testInputs()
+
+	sealed, err := Seal(masterKey, salt, info, header, nonce1, nonce2, plaintext)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	for i := range header {
+		tampered := append([]byte{}, header...)
+		tampered[i] ^= 0x01
+		if _, err := Open(masterKey, salt, info, tampered, nonce1, nonce2, sealed); err == nil {
+			t.Fatalf("Open accepted tampered header byte at offset %d", i)
+		}
+	}
+}
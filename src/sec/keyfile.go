@@ -0,0 +1,47 @@
+// keyfile.go
+package main
+
+import (
+	"crypto/rand"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// keyfileSize is an arbitrary but generous amount of random material for
+// a generated keyfile; any file at all works as a keyfile, this is just
+// a convenient way to create one with good entropy.
+const keyfileSize = 1024
+
+// hashKeyfile reads path and returns its SHA3-256 digest, which is what
+// actually gets mixed into the vault key (and stored, as a fingerprint,
+// in the header) rather than the keyfile's raw bytes. Streaming the file
+// through io.Copy rather than reading it into a []byte first means there's
+// no full-size keyfile buffer of our own left sitting on the heap to wipe.
+func hashKeyfile(path string) ([keyfileFingerprintSize]byte, error) {
+	var digest [keyfileFingerprintSize]byte
+	f, err := os.Open(path)
+	if err != nil {
+		return digest, err
+	}
+	defer f.Close()
+
+	h := sha3.New256()
+	if _, err := io.Copy(h, f); err != nil {
+		return digest, err
+	}
+	copy(digest[:], h.Sum(nil))
+	return digest, nil
+}
+
+// generateKeyfile writes keyfileSize bytes of random data to path, mode
+// 0600, for use with --keyfile.
+func generateKeyfile(path string) error {
+	buf := NewSecretBytes(make([]byte, keyfileSize))
+	defer buf.Zero()
+	if _, err := rand.Read(buf.Bytes()); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0600)
+}
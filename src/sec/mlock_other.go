@@ -0,0 +1,11 @@
+//go:build !unix
+
+// mlock_other.go
+package main
+
+// mlockBestEffort and munlockBestEffort are no-ops outside unix: there's
+// no portable mlock equivalent worth shelling out for here, and the rest
+// of the wipe-on-use path (SecretBytes.Zero) still applies regardless.
+func mlockBestEffort(b []byte) {}
+
+func munlockBestEffort(b []byte) {}
@@ -0,0 +1,37 @@
+//go:build unix
+
+// mlock_unix.go
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mlockBestEffort locks b into RAM so the plaintext arena it backs can't
+// be paged to swap. It's best-effort: a low RLIMIT_MEMLOCK (the common
+// case for an unprivileged user) makes unix.Mlock fail, and that's not
+// worth aborting the command over, so each failed call just prints a
+// warning and moves on.
+func mlockBestEffort(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	if err := unix.Mlock(b); err != nil {
+		var rlimit unix.Rlimit
+		limit := "unknown"
+		if rerr := unix.Getrlimit(unix.RLIMIT_MEMLOCK, &rlimit); rerr == nil {
+			limit = fmt.Sprintf("%d bytes", rlimit.Cur)
+		}
+		fmt.Fprintf(os.Stderr, "warning: mlock failed (%v), plaintext may be swapped to disk; RLIMIT_MEMLOCK is %s\n", err, limit)
+	}
+}
+
+func munlockBestEffort(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	_ = unix.Munlock(b)
+}
@@ -1,23 +1,42 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/json"
-	"errors"
+	"context"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
-	"golang.org/x/crypto/bcrypt"
-	"golang.org/x/crypto/chacha20poly1305"
-	"golang.org/x/term"
 )
 
-type SecretStore map[string]string
+// SecretEntry carries a per-key timestamp alongside the value so that
+// sync (see sync.go) can resolve conflicting edits from different
+// devices with last-writer-wins, and a tombstone bit so deletes
+// propagate instead of silently resurrecting the key on the next merge.
+// Value is a *SecretBytes rather than a string so it can be wiped with
+// Zero() once a command is done with it; see storecodec.go for how the
+// store is serialized without ever copying a value into a string.
+type SecretEntry struct {
+	Value     *SecretBytes
+	UpdatedAt time.Time
+	Deleted   bool
+}
+
+type SecretStore map[string]SecretEntry
+
+// Zero wipes every entry's value. decodeStore hands back a copy of each
+// value rather than a slice into the decrypted arena (see storecodec.go),
+// so a command that's done with a store has to zero every entry itself,
+// not just the one key it happened to touch, or the rest sit on the heap
+// unwiped for the life of the process.
+func (s SecretStore) Zero() {
+	for _, entry := range s {
+		entry.Value.Zero()
+	}
+}
 
 const version = "0.1.1"
 
@@ -29,10 +48,7 @@ var versionCmd = &cobra.Command{
 	},
 }
 
-const (
-	defaultSecretsFile = "~/.sec.enc"
-	pinKey             = "__meta__pin_hash"
-)
+const defaultSecretsFile = "~/.sec.enc"
 
 func expandPath(p string) string {
 	if strings.HasPrefix(p, "~") {
@@ -42,190 +58,187 @@ func expandPath(p string) string {
 	return p
 }
 
-func getOrCreateStaticKey() ([]byte, error) {
-	keyPath := expandPath("~/.sec.key")
-	if data, err := ioutil.ReadFile(keyPath); err == nil {
-		if len(data) == 32 {
-			return data, nil
-		}
-		return nil, fmt.Errorf("invalid key file length")
-	} else if os.IsNotExist(err) {
-		key := make([]byte, 32)
-		if _, err := rand.Read(key); err != nil {
-			return nil, err
-		}
-		if err := ioutil.WriteFile(keyPath, key, 0600); err != nil {
-			return nil, err
-		}
-		return key, nil
-	} else {
-		return nil, err
-	}
+// session carries the master password for the lifetime of a single
+// command invocation. It is threaded through cobra's command context
+// rather than kept in a package global so that nothing outside the
+// command that asked for it can read the password back out.
+type session struct {
+	password      *SecretBytes
+	paranoid      bool
+	fec           bool
+	keyfileDigest *[keyfileFingerprintSize]byte
 }
 
-func encryptStore(store SecretStore, key []byte) ([]byte, error) {
-	aead, err := chacha20poly1305.NewX(key)
-	if err != nil {
-		return nil, err
-	}
-	plaintext, err := json.Marshal(store)
-	if err != nil {
-		return nil, err
-	}
-	nonce := make([]byte, chacha20poly1305.NonceSizeX)
-	if _, err := rand.Read(nonce); err != nil {
-		return nil, err
-	}
-	ciphertext := aead.Seal(nonce, nonce, plaintext, nil)
-	return ciphertext, nil
+type sessionKey struct{}
+
+func withSession(ctx context.Context, s *session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, s)
 }
 
-func decryptStore(data []byte, key []byte) (SecretStore, error) {
-	aead, err := chacha20poly1305.NewX(key)
-	if err != nil {
-		return nil, err
-	}
-	if len(data) < chacha20poly1305.NonceSizeX {
-		return nil, errors.New("invalid ciphertext: too short")
-	}
-	nonce := data[:chacha20poly1305.NonceSizeX]
-	ciphertext := data[chacha20poly1305.NonceSizeX:]
-	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
-	if err != nil {
-		return nil, err
-	}
-	var store SecretStore
-	if err := json.Unmarshal(plaintext, &store); err != nil {
-		return nil, err
-	}
-	return store, nil
+func sessionFromContext(ctx context.Context) *session {
+	s, _ := ctx.Value(sessionKey{}).(*session)
+	return s
 }
 
-func loadStore(path string, key []byte) (SecretStore, error) {
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return make(SecretStore), nil
-		}
-		return nil, err
+func argonParamsForSession(s *session) argonParams {
+	if s.paranoid {
+		return paranoidArgonParams
 	}
-	return decryptStore(data, key)
+	return defaultArgonParams
 }
 
-func saveStore(path string, store SecretStore, key []byte) error {
-	data, err := encryptStore(store, key)
-	if err != nil {
-		return err
-	}
-	return ioutil.WriteFile(path, data, 0600)
+func flagsForSession(s *session) flags {
+	return newFlags(s.fec, s.paranoid, s.keyfileDigest != nil)
 }
 
-func promptPIN(prompt string) (string, error) {
-	fmt.Print(prompt)
-	bytePIN, err := term.ReadPassword(int(os.Stdin.Fd()))
-	fmt.Println()
-	if err != nil {
-		return "", err
+// resolveRekeyFlags decides the argon params/flags a rekey-style command
+// (rekey, keyfile rotate) should save the vault with. Rotating a
+// password or keyfile shouldn't silently strip protections the vault
+// already had, so the existing header wins unless the user explicitly
+// passed --paranoid/--fec on this invocation; existing is nil for a
+// vault that doesn't exist yet, in which case the flags behave as they
+// do everywhere else.
+func resolveRekeyFlags(existing *vaultHeader, cmd *cobra.Command, paranoidFlag, fecFlag, keyfile bool) (argonParams, flags) {
+	if existing == nil {
+		params := defaultArgonParams
+		if paranoidFlag {
+			params = paranoidArgonParams
+		}
+		return params, newFlags(fecFlag, paranoidFlag, keyfile)
 	}
-	return string(bytePIN), nil
-}
 
-func requirePIN(store SecretStore) error {
-	hash, ok := store[pinKey]
-	if !ok {
-		return nil // No PIN set
+	paranoid := existing.flags.paranoid()
+	if cmd.Flags().Changed("paranoid") {
+		paranoid = paranoidFlag
+	}
+	fec := existing.flags.fec()
+	if cmd.Flags().Changed("fec") {
+		fec = fecFlag
 	}
 
-	const maxAttempts = 3
-	for i := 0; i < maxAttempts; i++ {
-		pin, err := promptPIN("Enter PIN: ")
-		if err != nil {
-			return err
-		}
-		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(pin)) == nil {
-			return nil
+	if existing.flags.paranoid() && !paranoid {
+		fmt.Println("warning: dropping --paranoid protection from this vault")
+	}
+	if existing.flags.fec() && !fec {
+		fmt.Println("warning: dropping --fec protection from this vault")
+	}
+
+	params := existing.params
+	if paranoid != existing.flags.paranoid() {
+		params = defaultArgonParams
+		if paranoid {
+			params = paranoidArgonParams
 		}
-		fmt.Println("Incorrect PIN.")
 	}
-	return errors.New("too many incorrect attempts")
+	return params, newFlags(fec, paranoid, keyfile)
 }
 
 func main() {
 	var fileFlag string
+	var paranoidFlag bool
+	var fecFlag bool
+	var keyfileFlag string
+
 	var rootCmd = &cobra.Command{
 		Use:     "sec",
 		Version: "0.0.1",
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
-			key, err := getOrCreateStaticKey()
-			if err != nil {
-				return err
+			path := expandPath(fileFlag)
+
+			var keyfileDigest *[keyfileFingerprintSize]byte
+			if keyfileFlag != "" {
+				digest, err := hashKeyfile(keyfileFlag)
+				if err != nil {
+					return fmt.Errorf("keyfile: %w", err)
+				}
+				keyfileDigest = &digest
+			}
+
+			// With --keyfile set, an empty password (just pressing enter
+			// at the prompt) is fine: the keyfile digest alone is mixed
+			// into the key, so the vault isn't left unprotected.
+			var password *SecretBytes
+			var err error
+			if vaultExists(path) {
+				password, err = promptExistingPassword()
+			} else {
+				password, err = promptNewPassword()
 			}
-			store, err := loadStore(expandPath(fileFlag), key)
 			if err != nil {
 				return err
 			}
-			// Only prompt for PIN if one is set
-			if _, ok := store[pinKey]; ok {
-				return requirePIN(store)
-			}
+			cmd.SetContext(withSession(cmd.Context(), &session{password: password, paranoid: paranoidFlag, fec: fecFlag, keyfileDigest: keyfileDigest}))
 			return nil
 		},
 	}
 	rootCmd.PersistentFlags().StringVarP(&fileFlag, "file", "f", defaultSecretsFile, "Path to secrets file")
+	rootCmd.PersistentFlags().BoolVar(&paranoidFlag, "paranoid", false, "Use higher-cost Argon2id parameters and a ChaCha20+Serpent cascade cipher for new vaults")
+	rootCmd.PersistentFlags().BoolVar(&fecFlag, "fec", false, "Protect the vault with Reed-Solomon forward error correction")
+	rootCmd.PersistentFlags().StringVar(&keyfileFlag, "keyfile", "", "Path to a keyfile to mix into the vault key as a second factor")
 
 	var setCmd = &cobra.Command{
 		Use:   "set",
 		Short: "Set a secret value",
 		Args:  cobra.ExactArgs(2),
 		Run: func(cmd *cobra.Command, args []string) {
-			key, err := getOrCreateStaticKey()
+			sess := sessionFromContext(cmd.Context())
+			defer sess.password.Zero()
+			path := expandPath(fileFlag)
+			store, err := loadStore(path, sess.password.Bytes(), sess.keyfileDigest, false)
 			if err != nil {
 				log.Fatal(err)
 			}
-			store, err := loadStore(expandPath(fileFlag), key)
-			if err != nil {
-				log.Fatal(err)
-			}
-			store[args[0]] = args[1]
-			if err := saveStore(expandPath(fileFlag), store, key); err != nil {
+			defer store.Zero()
+			store[args[0]] = SecretEntry{Value: NewSecretBytes([]byte(args[1])), UpdatedAt: time.Now()}
+			if err := saveStore(path, store, sess.password.Bytes(), argonParamsForSession(sess), flagsForSession(sess), sess.keyfileDigest); err != nil {
 				log.Fatal(err)
 			}
 			fmt.Println("Secret set.")
 		},
 	}
 
+	var getFixFlag bool
 	var getCmd = &cobra.Command{
 		Use:   "get",
 		Short: "Get a secret value",
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			key, err := getOrCreateStaticKey()
+			sess := sessionFromContext(cmd.Context())
+			defer sess.password.Zero()
+			store, err := loadStore(expandPath(fileFlag), sess.password.Bytes(), sess.keyfileDigest, getFixFlag)
 			if err != nil {
 				log.Fatal(err)
 			}
-			store, err := loadStore(expandPath(fileFlag), key)
-			if err != nil {
-				log.Fatal(err)
+			defer store.Zero()
+			entry, ok := store[args[0]]
+			if ok && !entry.Deleted {
+				fmt.Println(string(entry.Value.Bytes()))
 			}
-			fmt.Println(store[args[0]])
 		},
 	}
+	getCmd.Flags().BoolVar(&getFixFlag, "fix", false, "On a --fec vault, substitute the raw bytes of any unrecoverable chunk instead of aborting")
 
 	var deleteCmd = &cobra.Command{
 		Use:   "delete",
 		Short: "Delete a secret",
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			key, err := getOrCreateStaticKey()
+			sess := sessionFromContext(cmd.Context())
+			defer sess.password.Zero()
+			path := expandPath(fileFlag)
+			store, err := loadStore(path, sess.password.Bytes(), sess.keyfileDigest, false)
 			if err != nil {
 				log.Fatal(err)
 			}
-			store, err := loadStore(expandPath(fileFlag), key)
-			if err != nil {
-				log.Fatal(err)
+			defer store.Zero()
+			if old, ok := store[args[0]]; ok {
+				old.Value.Zero()
 			}
-			delete(store, args[0])
-			if err := saveStore(expandPath(fileFlag), store, key); err != nil {
+			// Tombstone rather than delete outright so sync propagates
+			// the deletion to other devices instead of a later merge
+			// resurrecting the key from a peer's older copy.
+			store[args[0]] = SecretEntry{UpdatedAt: time.Now(), Deleted: true}
+			if err := saveStore(path, store, sess.password.Bytes(), argonParamsForSession(sess), flagsForSession(sess), sess.keyfileDigest); err != nil {
 				log.Fatal(err)
 			}
 			fmt.Println("Secret deleted.")
@@ -236,23 +249,214 @@ func main() {
 		Use:   "list",
 		Short: "List all stored keys",
 		Run: func(cmd *cobra.Command, args []string) {
-			key, err := getOrCreateStaticKey()
+			sess := sessionFromContext(cmd.Context())
+			defer sess.password.Zero()
+			store, err := loadStore(expandPath(fileFlag), sess.password.Bytes(), sess.keyfileDigest, false)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer store.Zero()
+			for k, entry := range store {
+				if !entry.Deleted {
+					fmt.Println(k)
+				}
+			}
+		},
+	}
+
+	var rekeyCmd = &cobra.Command{
+		Use:   "rekey",
+		Short: "Re-encrypt the vault with a new password and/or Argon2id parameters",
+		Run: func(cmd *cobra.Command, args []string) {
+			sess := sessionFromContext(cmd.Context())
+			defer sess.password.Zero()
+			path := expandPath(fileFlag)
+			store, err := loadStore(path, sess.password.Bytes(), sess.keyfileDigest, false)
 			if err != nil {
 				log.Fatal(err)
 			}
-			store, err := loadStore(expandPath(fileFlag), key)
+			defer store.Zero()
+			newPassword, err := promptNewPassword()
 			if err != nil {
 				log.Fatal(err)
 			}
-			for k := range store {
-				if k != pinKey {
-					fmt.Println(k)
-				}
+			defer newPassword.Zero()
+			existing, err := peekVaultHeader(path)
+			if err != nil {
+				log.Fatal(err)
+			}
+			params, f := resolveRekeyFlags(existing, cmd, paranoidFlag, fecFlag, sess.keyfileDigest != nil)
+			if err := saveStore(path, store, newPassword.Bytes(), params, f, sess.keyfileDigest); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println("Vault rekeyed.")
+		},
+	}
+
+	// verify and repair operate below the AEAD layer (they only touch
+	// the Reed-Solomon framing of a --fec vault), so they skip the
+	// master password prompt entirely.
+	var verifyCmd = &cobra.Command{
+		Use:   "verify",
+		Short: "Check a --fec vault for bit rot without decrypting it",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			data, err := os.ReadFile(expandPath(fileFlag))
+			if err != nil {
+				log.Fatal(err)
+			}
+			report, _, err := fecInspectFile(data)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("header blocks: %d/%d unrecoverable\n", report.BadHeaderBlocks, report.HeaderBlocks)
+			fmt.Printf("chunks: %d/%d unrecoverable\n", report.BadChunks, report.Chunks)
+			if report.BadHeaderBlocks > 0 || report.BadChunks > 0 {
+				os.Exit(1)
 			}
 		},
 	}
 
-	rootCmd.AddCommand(setCmd, getCmd, deleteCmd, listCmd)
+	var repairCmd = &cobra.Command{
+		Use:   "repair",
+		Short: "Rewrite a --fec vault with every recoverable block reconstructed",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			path := expandPath(fileFlag)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				log.Fatal(err)
+			}
+			report, repaired, err := fecInspectFile(data)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := os.WriteFile(path, repaired, 0600); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("vault rewritten; %d/%d header blocks and %d/%d chunks were unrecoverable\n",
+				report.BadHeaderBlocks, report.HeaderBlocks, report.BadChunks, report.Chunks)
+		},
+	}
+
+	var syncCmd = &cobra.Command{
+		Use:   "sync",
+		Short: "Replicate the vault to and from other tag:sec Tailscale devices",
+	}
+
+	var syncPushCmd = &cobra.Command{
+		Use:   "push",
+		Short: "Merge every tag:sec peer's vault into this one, then push the result back out",
+		Run: func(cmd *cobra.Command, args []string) {
+			sess := sessionFromContext(cmd.Context())
+			defer sess.password.Zero()
+			if err := syncPush(expandPath(fileFlag), sess); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	var syncPullCmd = &cobra.Command{
+		Use:   "pull",
+		Short: "Merge every tag:sec peer's vault into this one",
+		Run: func(cmd *cobra.Command, args []string) {
+			sess := sessionFromContext(cmd.Context())
+			defer sess.password.Zero()
+			if err := syncPull(expandPath(fileFlag), sess); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	var syncDaemonCmd = &cobra.Command{
+		Use:   "daemon",
+		Short: "Listen on the tailnet and merge incoming vaults from tag:sec peers",
+		Run: func(cmd *cobra.Command, args []string) {
+			sess := sessionFromContext(cmd.Context())
+			if err := runSyncDaemon(expandPath(fileFlag), sess); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	var syncStatusCmd = &cobra.Command{
+		Use:   "status",
+		Short: "Show which tag:sec peers are in sync and which have drifted",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := syncStatus(expandPath(fileFlag)); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	syncCmd.AddCommand(syncPushCmd, syncPullCmd, syncDaemonCmd, syncStatusCmd)
+
+	var keyfileCmd = &cobra.Command{
+		Use:   "keyfile",
+		Short: "Generate or rotate a --keyfile second factor",
+	}
+
+	// generate writes a fresh random keyfile and doesn't touch the
+	// vault at all, so it skips the master password prompt.
+	var keyfileGenerateCmd = &cobra.Command{
+		Use:   "generate PATH",
+		Short: "Create a new random keyfile",
+		Args:  cobra.ExactArgs(1),
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := generateKeyfile(args[0]); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println("Keyfile written to", args[0])
+		},
+	}
+
+	var newKeyfileFlag string
+	var keyfileRotateCmd = &cobra.Command{
+		Use:   "rotate",
+		Short: "Re-encrypt the vault with a different keyfile",
+		Run: func(cmd *cobra.Command, args []string) {
+			sess := sessionFromContext(cmd.Context())
+			defer sess.password.Zero()
+			path := expandPath(fileFlag)
+			store, err := loadStore(path, sess.password.Bytes(), sess.keyfileDigest, false)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer store.Zero()
+			newDigest, err := hashKeyfile(newKeyfileFlag)
+			if err != nil {
+				log.Fatal(err)
+			}
+			existing, err := peekVaultHeader(path)
+			if err != nil {
+				log.Fatal(err)
+			}
+			params, f := resolveRekeyFlags(existing, cmd, paranoidFlag, fecFlag, true)
+			if err := saveStore(path, store, sess.password.Bytes(), params, f, &newDigest); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println("Vault rekeyed with new keyfile.")
+		},
+	}
+	keyfileRotateCmd.Flags().StringVar(&newKeyfileFlag, "new-keyfile", "", "Path to the new keyfile to adopt")
+	keyfileRotateCmd.MarkFlagRequired("new-keyfile")
+
+	keyfileCmd.AddCommand(keyfileGenerateCmd, keyfileRotateCmd)
+
+	rootCmd.AddCommand(setCmd, getCmd, deleteCmd, listCmd, rekeyCmd)
+	rootCmd.AddCommand(verifyCmd, repairCmd)
+	rootCmd.AddCommand(syncCmd)
+	rootCmd.AddCommand(keyfileCmd)
 	rootCmd.AddCommand(versionCmd)
 
 	if err := rootCmd.Execute(); err != nil {
@@ -0,0 +1,46 @@
+// secretbytes.go
+package main
+
+import (
+	"crypto/subtle"
+	"runtime"
+)
+
+// SecretBytes wraps a byte slice holding sensitive material — a master
+// password, PIN, derived key, or decrypted plaintext — so it can be
+// wiped with Zero() once the caller is done with it. A plain string
+// can't play this role: its backing array is immutable, so a password
+// read into one lives on the heap for as long as the GC feels like
+// keeping it.
+type SecretBytes struct {
+	b []byte
+}
+
+// NewSecretBytes takes ownership of b; callers should not use b directly
+// after handing it to NewSecretBytes.
+func NewSecretBytes(b []byte) *SecretBytes {
+	return &SecretBytes{b: b}
+}
+
+func (sb *SecretBytes) Bytes() []byte {
+	if sb == nil {
+		return nil
+	}
+	return sb.b
+}
+
+// Zero overwrites the wrapped bytes with zeros. subtle.ConstantTimeCompare
+// reads every byte of b after the overwrite loop, which gives the
+// compiler an observable use of the zeroed buffer and so keeps it from
+// proving the loop is dead and eliding it; runtime.KeepAlive then pins b
+// past that call so nothing here gets reordered away by escape analysis.
+func (sb *SecretBytes) Zero() {
+	if sb == nil {
+		return
+	}
+	for i := range sb.b {
+		sb.b[i] = 0
+	}
+	subtle.ConstantTimeCompare(sb.b, sb.b)
+	runtime.KeepAlive(sb.b)
+}
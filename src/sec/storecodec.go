@@ -0,0 +1,106 @@
+// storecodec.go
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// encodeStore serializes store into a small length-prefixed binary
+// format instead of encoding/json: encoding/json would base64 a secret
+// value through an intermediate Go string on the way out, and a string's
+// backing array can never be wiped. This format copies value bytes
+// straight from each entry's SecretBytes into buf.
+//
+// Layout: uint32 entry count, then per entry:
+//
+//	uint32 keyLen, key bytes,
+//	uint8 deleted,
+//	int64 updatedAt (UnixNano, big-endian),
+//	uint32 valueLen, value bytes
+func encodeStore(store SecretStore) []byte {
+	buf := make([]byte, 0, 64*len(store)+4)
+	buf = appendUint32(buf, uint32(len(store)))
+
+	for k, entry := range store {
+		buf = appendUint32(buf, uint32(len(k)))
+		buf = append(buf, k...)
+
+		var deleted byte
+		if entry.Deleted {
+			deleted = 1
+		}
+		buf = append(buf, deleted)
+
+		var tsBuf [8]byte
+		binary.BigEndian.PutUint64(tsBuf[:], uint64(entry.UpdatedAt.UnixNano()))
+		buf = append(buf, tsBuf[:]...)
+
+		value := entry.Value.Bytes()
+		buf = appendUint32(buf, uint32(len(value)))
+		buf = append(buf, value...)
+	}
+	return buf
+}
+
+// decodeStore parses the format encodeStore writes. Every value it hands
+// back is copied into its own freshly allocated SecretBytes rather than
+// sliced from data, so the caller is free to zero data afterwards without
+// corrupting the store it just produced.
+func decodeStore(data []byte) (SecretStore, error) {
+	count, pos, ok := readUint32(data, 0)
+	if !ok {
+		return nil, errors.New("invalid store: truncated")
+	}
+
+	store := make(SecretStore, count)
+	for i := uint32(0); i < count; i++ {
+		keyLen, next, ok := readUint32(data, pos)
+		if !ok {
+			return nil, errors.New("invalid store: truncated key length")
+		}
+		pos = next
+		if pos+int(keyLen) > len(data) {
+			return nil, errors.New("invalid store: truncated key")
+		}
+		key := string(data[pos : pos+int(keyLen)])
+		pos += int(keyLen)
+
+		if pos+1+8 > len(data) {
+			return nil, errors.New("invalid store: truncated entry")
+		}
+		deleted := data[pos] == 1
+		pos++
+		updatedAt := time.Unix(0, int64(binary.BigEndian.Uint64(data[pos:pos+8]))).UTC()
+		pos += 8
+
+		valueLen, next, ok := readUint32(data, pos)
+		if !ok {
+			return nil, errors.New("invalid store: truncated value length")
+		}
+		pos = next
+		if pos+int(valueLen) > len(data) {
+			return nil, errors.New("invalid store: truncated value")
+		}
+		value := make([]byte, valueLen)
+		copy(value, data[pos:pos+int(valueLen)])
+		pos += int(valueLen)
+
+		store[key] = SecretEntry{Value: NewSecretBytes(value), UpdatedAt: updatedAt, Deleted: deleted}
+	}
+	return store, nil
+}
+
+func appendUint32(buf []byte, n uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], n)
+	return append(buf, b[:]...)
+}
+
+func readUint32(data []byte, pos int) (n uint32, next int, ok bool) {
+	if pos+4 > len(data) {
+		return 0, pos, false
+	}
+	return binary.BigEndian.Uint32(data[pos : pos+4]), pos + 4, true
+}
@@ -0,0 +1,317 @@
+// sync.go
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+
+	"tailscale.com/client/tailscale"
+	"tailscale.com/tsnet"
+)
+
+// syncTag is the Tailscale ACL tag that marks a device as one of this
+// user's own vault-syncing peers, the same convention the prototype in
+// store/filter_sec.go used.
+const syncTag = "tag:sec"
+
+const syncPort = 8443
+
+type syncPeer struct {
+	Hostname string
+	Addr     string
+}
+
+// tailscaleStatus is the subset of `tailscale status --json` this package
+// needs to find the user's other tag:sec devices.
+type tailscaleStatus struct {
+	Self *tailscalePeerStatus            `json:"Self"`
+	Peer map[string]*tailscalePeerStatus `json:"Peer"`
+}
+
+type tailscalePeerStatus struct {
+	HostName     string   `json:"HostName"`
+	TailscaleIPs []string `json:"TailscaleIPs"`
+	Tags         []string `json:"Tags"`
+}
+
+// discoverSyncPeers shells out to the Tailscale CLI (rather than reading
+// a locally exported tailscale.json, as the old prototype did) and
+// returns every other device tagged tag:sec in the current tailnet.
+func discoverSyncPeers() ([]syncPeer, error) {
+	out, err := exec.Command("tailscale", "status", "--json").Output()
+	if err != nil {
+		return nil, fmt.Errorf("tailscale status: %w", err)
+	}
+	var st tailscaleStatus
+	if err := json.Unmarshal(out, &st); err != nil {
+		return nil, err
+	}
+
+	var peers []syncPeer
+	for _, p := range st.Peer {
+		if st.Self != nil && p.HostName == st.Self.HostName {
+			continue
+		}
+		if !hasTag(p.Tags, syncTag) || len(p.TailscaleIPs) == 0 {
+			continue
+		}
+		peers = append(peers, syncPeer{Hostname: p.HostName, Addr: p.TailscaleIPs[0]})
+	}
+	return peers, nil
+}
+
+func hasTag(tags []string, want string) bool {
+	for _, t := range tags {
+		if t == want {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeStores resolves a and b into one store with a per-key
+// last-writer-wins policy: whichever side has the newer UpdatedAt for a
+// key (including tombstones) survives the merge. The losing side of
+// every conflict is zeroed here, since it's discarded and never makes
+// it into merged, so nothing else gets a chance to wipe it.
+func mergeStores(a, b SecretStore) SecretStore {
+	merged := make(SecretStore, len(a)+len(b))
+	for k, v := range a {
+		merged[k] = v
+	}
+	for k, v := range b {
+		existing, ok := merged[k]
+		if !ok || v.UpdatedAt.After(existing.UpdatedAt) {
+			if ok {
+				existing.Value.Zero()
+			}
+			merged[k] = v
+		} else {
+			v.Value.Zero()
+		}
+	}
+	return merged
+}
+
+func vaultURL(peer syncPeer) string {
+	return fmt.Sprintf("http://%s:%d/vault", peer.Addr, syncPort)
+}
+
+// fetchVault GETs the raw encrypted blob from a peer's sync daemon.
+func fetchVault(peer syncPeer) ([]byte, error) {
+	resp, err := http.Get(vaultURL(peer))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: unexpected status %s", peer.Hostname, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func pushVault(peer syncPeer, data []byte) error {
+	resp, err := http.Post(vaultURL(peer), "application/octet-stream", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: unexpected status %s", peer.Hostname, resp.Status)
+	}
+	return nil
+}
+
+// syncPull merges every peer's vault into the local one.
+func syncPull(path string, sess *session) error {
+	peers, err := discoverSyncPeers()
+	if err != nil {
+		return err
+	}
+	local, err := loadStore(path, sess.password.Bytes(), sess.keyfileDigest, false)
+	if err != nil {
+		return err
+	}
+	// local is reassigned on every merge below, so the deferred zero has
+	// to read it through a closure rather than bind today's map value.
+	defer func() { local.Zero() }()
+	for _, peer := range peers {
+		remoteData, err := fetchVault(peer)
+		if err != nil {
+			fmt.Printf("pull %s: %v\n", peer.Hostname, err)
+			continue
+		}
+		remote, err := decryptStore(remoteData, sess.password.Bytes(), sess.keyfileDigest, false)
+		if err != nil {
+			fmt.Printf("pull %s: %v\n", peer.Hostname, err)
+			continue
+		}
+		defer remote.Zero()
+		local = mergeStores(local, remote)
+		fmt.Printf("pulled %s\n", peer.Hostname)
+	}
+	return saveStore(path, local, sess.password.Bytes(), argonParamsForSession(sess), flagsForSession(sess), sess.keyfileDigest)
+}
+
+// syncPush merges every peer's vault in the same way as syncPull, then
+// pushes the merged result back out to each peer so every device
+// converges on the same state.
+func syncPush(path string, sess *session) error {
+	peers, err := discoverSyncPeers()
+	if err != nil {
+		return err
+	}
+	local, err := loadStore(path, sess.password.Bytes(), sess.keyfileDigest, false)
+	if err != nil {
+		return err
+	}
+	defer func() { local.Zero() }()
+	for _, peer := range peers {
+		if remoteData, err := fetchVault(peer); err == nil {
+			if remote, err := decryptStore(remoteData, sess.password.Bytes(), sess.keyfileDigest, false); err == nil {
+				defer remote.Zero()
+				local = mergeStores(local, remote)
+			}
+		}
+	}
+	if err := saveStore(path, local, sess.password.Bytes(), argonParamsForSession(sess), flagsForSession(sess), sess.keyfileDigest); err != nil {
+		return err
+	}
+	merged, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for _, peer := range peers {
+		if err := pushVault(peer, merged); err != nil {
+			fmt.Printf("push %s: %v\n", peer.Hostname, err)
+			continue
+		}
+		fmt.Printf("pushed %s\n", peer.Hostname)
+	}
+	return nil
+}
+
+// syncStatus reports, for every tag:sec peer, whether its vault's
+// ciphertext matches the local one byte-for-byte (no drift) or not
+// (needs a push/pull), without decrypting anything.
+func syncStatus(path string) error {
+	localData, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	localSum := sha256.Sum256(localData)
+
+	peers, err := discoverSyncPeers()
+	if err != nil {
+		return err
+	}
+	if len(peers) == 0 {
+		fmt.Println("no tag:sec peers found")
+		return nil
+	}
+	for _, peer := range peers {
+		remoteData, err := fetchVault(peer)
+		if err != nil {
+			fmt.Printf("%-20s %-15s unreachable: %v\n", peer.Hostname, peer.Addr, err)
+			continue
+		}
+		remoteSum := sha256.Sum256(remoteData)
+		state := "drift"
+		if remoteSum == localSum {
+			state = "in sync"
+		}
+		fmt.Printf("%-20s %-15s %s\n", peer.Hostname, peer.Addr, state)
+	}
+	return nil
+}
+
+// requireSyncPeer checks, via tsnet's local API, that r was made by a
+// node tagged tag:sec. discoverSyncPeers's tag filtering only governs
+// which peers push/pull/status choose to talk to; it's client-side and
+// does nothing to stop any other device that can route to this listener
+// from calling it directly, so the handler has to re-check the caller
+// itself rather than trust that only tag:sec devices ever show up here.
+func requireSyncPeer(lc *tailscale.LocalClient, r *http.Request) error {
+	who, err := lc.WhoIs(r.Context(), r.RemoteAddr)
+	if err != nil {
+		return fmt.Errorf("whois %s: %w", r.RemoteAddr, err)
+	}
+	if who.Node == nil || !hasTag(who.Node.Tags, syncTag) {
+		return fmt.Errorf("caller is not a %s peer", syncTag)
+	}
+	return nil
+}
+
+// runSyncDaemon listens for GET/PUT /vault requests from other tag:sec
+// devices over the tailnet using tsnet, so the daemon doesn't need a
+// port exposed to anything but Tailscale peers.
+func runSyncDaemon(path string, sess *session) error {
+	srv := &tsnet.Server{Hostname: "sec-sync"}
+	defer srv.Close()
+
+	ln, err := srv.Listen("tcp", fmt.Sprintf(":%d", syncPort))
+	if err != nil {
+		return fmt.Errorf("tsnet listen: %w", err)
+	}
+	defer ln.Close()
+
+	lc, err := srv.LocalClient()
+	if err != nil {
+		return fmt.Errorf("tsnet local client: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/vault", func(w http.ResponseWriter, r *http.Request) {
+		if err := requireSyncPeer(lc, r); err != nil {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			data, err := os.ReadFile(path)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("X-Sec-Updated-At", time.Now().UTC().Format(time.RFC3339))
+			w.Write(data)
+		case http.MethodPost, http.MethodPut:
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			remote, err := decryptStore(body, sess.password.Bytes(), sess.keyfileDigest, false)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			defer remote.Zero()
+			local, err := loadStore(path, sess.password.Bytes(), sess.keyfileDigest, false)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer local.Zero()
+			merged := mergeStores(local, remote)
+			defer merged.Zero()
+			if err := saveStore(path, merged, sess.password.Bytes(), argonParamsForSession(sess), flagsForSession(sess), sess.keyfileDigest); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	fmt.Printf("sec sync daemon listening on the tailnet at port %d\n", syncPort)
+	return http.Serve(ln, mux)
+}
@@ -0,0 +1,480 @@
+// vault.go
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/term"
+	"os"
+)
+
+// flags packs the per-vault mode bits that live alongside the header
+// (fec, paranoid, keyfile) into a single byte, so the header format doesn't grow
+// a new field every time a new mode is added.
+type flags byte
+
+const (
+	flagFEC      flags = 1 << 0
+	flagParanoid flags = 1 << 1
+	flagKeyfile  flags = 1 << 2
+)
+
+func newFlags(fec, paranoid, keyfile bool) flags {
+	var f flags
+	if fec {
+		f |= flagFEC
+	}
+	if paranoid {
+		f |= flagParanoid
+	}
+	if keyfile {
+		f |= flagKeyfile
+	}
+	return f
+}
+
+func (f flags) fec() bool      { return f&flagFEC != 0 }
+func (f flags) paranoid() bool { return f&flagParanoid != 0 }
+func (f flags) keyfile() bool  { return f&flagKeyfile != 0 }
+
+// vaultMagic identifies a ~/.sec.enc file produced by this format. Older
+// files written by getOrCreateStaticKey did not carry a header at all, so
+// any file whose header (after the leading format byte) doesn't start
+// with this magic is rejected rather than guessed at.
+const vaultMagic = "SEC1"
+
+// vaultVersion is the plain (no Reed-Solomon) format: formatByte || magic ||
+// version || argonParams || salt || flags || keyfileFingerprint ||
+// nonce(s) || sealed body. vaultVersionFEC additionally RS-protects the
+// header and chunks the body; see fec.go. Which one a file uses is
+// detected in parseVaultHeader from the leading format byte rather than
+// chosen by the caller; the magic can't tell them apart, since an
+// RS-protected header starts with the raw header bytes, magic included.
+const (
+	vaultVersion    = 1
+	vaultVersionFEC = 2
+)
+
+const (
+	saltSize               = 16
+	nonceSize              = chacha20poly1305.NonceSizeX
+	keyfileFingerprintSize = 32
+
+	// rawHeaderV2Size is magic(4) + version(1) + argonParams(10) +
+	// salt(16) + flags(1) + keyfileFingerprint(32).
+	rawHeaderV2Size = 64
+
+	// plainHeaderSize is the same layout, unprotected.
+	plainHeaderSize = rawHeaderV2Size
+)
+
+// argonParams records the cost parameters a vault was encrypted with, so
+// loadStore can re-derive the same key from the master password without
+// the caller having to know (or agree on) a fixed cost. paramsVersion
+// exists purely so a future change to the parameter set doesn't have to
+// guess the layout of old headers.
+type argonParams struct {
+	paramsVersion byte
+	time          uint32
+	memory        uint32
+	threads       byte
+}
+
+var defaultArgonParams = argonParams{paramsVersion: 1, time: 4, memory: 1 << 20, threads: 4}
+var paranoidArgonParams = argonParams{paramsVersion: 1, time: 8, memory: 1 << 21, threads: 4}
+
+func (p argonParams) marshal() []byte {
+	b := make([]byte, 1+4+4+1)
+	b[0] = p.paramsVersion
+	binary.BigEndian.PutUint32(b[1:5], p.time)
+	binary.BigEndian.PutUint32(b[5:9], p.memory)
+	b[9] = p.threads
+	return b
+}
+
+func parseArgonParams(b []byte) (argonParams, error) {
+	if len(b) != 1+4+4+1 {
+		return argonParams{}, errors.New("invalid argon parameter block")
+	}
+	return argonParams{
+		paramsVersion: b[0],
+		time:          binary.BigEndian.Uint32(b[1:5]),
+		memory:        binary.BigEndian.Uint32(b[5:9]),
+		threads:       b[9],
+	}, nil
+}
+
+// vaultHeader is everything needed to re-derive the encryption key and
+// locate the ciphertext inside a vault file, short of the password (and
+// keyfile, if any) itself.
+type vaultHeader struct {
+	params             argonParams
+	salt               [saltSize]byte
+	flags              flags
+	keyfileFingerprint [keyfileFingerprintSize]byte
+}
+
+// marshalRawHeaderV2 builds the fixed rawHeaderV2Size-byte header that
+// gets RS-protected by fecEncodeHeader in --fec vaults.
+func marshalRawHeaderV2(params argonParams, salt [saltSize]byte, f flags, keyfileFingerprint [keyfileFingerprintSize]byte) []byte {
+	b := make([]byte, 0, rawHeaderV2Size)
+	b = append(b, vaultMagic...)
+	b = append(b, vaultVersionFEC)
+	b = append(b, params.marshal()...)
+	b = append(b, salt[:]...)
+	b = append(b, byte(f))
+	b = append(b, keyfileFingerprint[:]...)
+	return b
+}
+
+func parseRawHeaderV2(b []byte) (vaultHeader, error) {
+	if len(b) != rawHeaderV2Size {
+		return vaultHeader{}, errors.New("invalid vault: malformed header")
+	}
+	if string(b[:len(vaultMagic)]) != vaultMagic {
+		return vaultHeader{}, errors.New("invalid vault: header did not reconstruct to a valid magic (too much corruption)")
+	}
+	pos := len(vaultMagic)
+	if b[pos] != vaultVersionFEC {
+		return vaultHeader{}, fmt.Errorf("unsupported vault version %d", b[pos])
+	}
+	pos++
+	params, err := parseArgonParams(b[pos : pos+10])
+	if err != nil {
+		return vaultHeader{}, err
+	}
+	pos += 10
+	var hdr vaultHeader
+	hdr.params = params
+	copy(hdr.salt[:], b[pos:pos+saltSize])
+	pos += saltSize
+	hdr.flags = flags(b[pos])
+	pos++
+	copy(hdr.keyfileFingerprint[:], b[pos:pos+keyfileFingerprintSize])
+	return hdr, nil
+}
+
+func deriveKey(password []byte, salt []byte, params argonParams) *SecretBytes {
+	return NewSecretBytes(argon2.IDKey(password, salt, params.time, params.memory, uint8(params.threads), 32))
+}
+
+// deriveVaultKey derives the final vault encryption key: the Argon2id
+// output on its own, or XORed with a keyfile's SHA3-256 digest when the
+// vault was sealed with --keyfile. Callers own the returned key and are
+// responsible for calling Zero() on it once they're done sealing/opening.
+func deriveVaultKey(password []byte, salt []byte, params argonParams, keyfileDigest *[keyfileFingerprintSize]byte) *SecretBytes {
+	key := deriveKey(password, salt, params)
+	if keyfileDigest == nil {
+		return key
+	}
+	kb := key.Bytes()
+	for i := range kb {
+		kb[i] ^= keyfileDigest[i]
+	}
+	return key
+}
+
+// encryptStore serializes store and writes it out as a full vault file:
+// formatByte || header || nonce(s) || sealed. formatByte is a single
+// unprotected byte (vaultVersion or vaultVersionFEC) so parseVaultHeader
+// can tell a plain header from an RS-protected one without relying on a
+// magic-prefix match — since fecEncodeHeader is a systematic code, an
+// RS-protected header's first bytes are the raw header bytes themselves,
+// magic string included, so the magic alone can't disambiguate the two.
+// Without fec the header is magic || version || argonParams || salt ||
+// flags || keyfileFingerprint; with fec the header and sealed body are
+// additionally RS-protected as described in fec.go. Without paranoid the
+// body is sealed with a single XChaCha20-Poly1305 pass; with paranoid it
+// goes through the internal/crypto cascade instead, which needs two
+// nonces rather than one. keyfileDigest is nil unless the vault is being
+// sealed with --keyfile.
+func encryptStore(store SecretStore, password []byte, params argonParams, f flags, keyfileDigest *[keyfileFingerprintSize]byte) ([]byte, error) {
+	var salt [saltSize]byte
+	if _, err := rand.Read(salt[:]); err != nil {
+		return nil, err
+	}
+	key := deriveVaultKey(password, salt[:], params, keyfileDigest)
+	defer key.Zero()
+
+	plaintext := NewSecretBytes(encodeStore(store))
+	mlockBestEffort(plaintext.Bytes())
+	defer munlockBestEffort(plaintext.Bytes())
+	defer plaintext.Zero()
+
+	var fingerprint [keyfileFingerprintSize]byte
+	if keyfileDigest != nil {
+		fingerprint = *keyfileDigest
+	}
+
+	var headerBytes []byte
+	if f.fec() {
+		headerBytes = marshalRawHeaderV2(params, salt, f, fingerprint)
+	} else {
+		headerBytes = marshalPlainHeader(params, salt, f, fingerprint)
+	}
+
+	nonce, sealed, err := sealBody(key.Bytes(), salt[:], headerBytes, plaintext.Bytes(), f.paranoid())
+	if err != nil {
+		return nil, err
+	}
+
+	formatByte := byte(vaultVersion)
+	if f.fec() {
+		formatByte = vaultVersionFEC
+	}
+
+	if !f.fec() {
+		out := make([]byte, 0, 1+len(headerBytes)+len(nonce)+len(sealed))
+		out = append(out, formatByte)
+		out = append(out, headerBytes...)
+		out = append(out, nonce...)
+		out = append(out, sealed...)
+		return out, nil
+	}
+
+	protectedHeader, err := fecEncodeHeader(headerBytes)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, 1+len(protectedHeader)+len(nonce)+len(sealed)+8)
+	out = append(out, formatByte)
+	out = append(out, protectedHeader...)
+	out = append(out, nonce...)
+	out = append(out, fecEncodeBody(sealed)...)
+	return out, nil
+}
+
+// decryptStore parses a vault file and decrypts it with a key derived
+// from password (and keyfileDigest, if the vault was sealed with one)
+// and the header's own Argon2id parameters and salt. fix is only
+// meaningful for a --fec vault: if false, an unrecoverable chunk aborts
+// the decode; if true, the raw (unrepaired) bytes of that chunk are
+// substituted so the AEAD tag failure is localized to the bytes that
+// were actually corrupted rather than the whole vault refusing to open.
+func decryptStore(data []byte, password []byte, keyfileDigest *[keyfileFingerprintSize]byte, fix bool) (SecretStore, error) {
+	hdr, rest, err := parseVaultHeader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if hdr.flags.keyfile() {
+		if keyfileDigest == nil || *keyfileDigest != hdr.keyfileFingerprint {
+			return nil, errors.New("wrong keyfile")
+		}
+	}
+
+	var headerBytes []byte
+	if hdr.flags.fec() {
+		headerBytes = marshalRawHeaderV2(hdr.params, hdr.salt, hdr.flags, hdr.keyfileFingerprint)
+	} else {
+		headerBytes = marshalPlainHeader(hdr.params, hdr.salt, hdr.flags, hdr.keyfileFingerprint)
+	}
+
+	bodyNonceSize := nonceSize
+	if hdr.flags.paranoid() {
+		bodyNonceSize = cascadeNonceSize
+	}
+	if len(rest) < bodyNonceSize {
+		return nil, errors.New("invalid vault: truncated nonce")
+	}
+	nonce := rest[:bodyNonceSize]
+	body := rest[bodyNonceSize:]
+
+	sealed := body
+	if hdr.flags.fec() {
+		sealed, _, err = fecDecodeBody(body, fix)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var digest *[keyfileFingerprintSize]byte
+	if hdr.flags.keyfile() {
+		digest = keyfileDigest
+	}
+	key := deriveVaultKey(password, hdr.salt[:], hdr.params, digest)
+	defer key.Zero()
+	plaintextBytes, err := openBody(key.Bytes(), hdr.salt[:], headerBytes, nonce, sealed, hdr.flags.paranoid())
+	if err != nil {
+		return nil, errors.New("wrong password or corrupt vault")
+	}
+	plaintext := NewSecretBytes(plaintextBytes)
+	mlockBestEffort(plaintext.Bytes())
+	defer munlockBestEffort(plaintext.Bytes())
+	defer plaintext.Zero()
+
+	store, err := decodeStore(plaintext.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// parseVaultHeader reads the leading format byte off data and dispatches
+// on it, returning the header plus whatever bytes follow (nonce || body).
+// The format byte has to be read unprotected, before any RS-decoding:
+// fecEncodeHeader is a systematic code, so an RS-protected header's first
+// bytes are the raw header bytes themselves, magic string included, and
+// sniffing for that magic can't tell a protected header from a plain one.
+func parseVaultHeader(data []byte) (vaultHeader, []byte, error) {
+	if len(data) < 1 {
+		return vaultHeader{}, nil, errors.New("invalid vault: too short")
+	}
+	formatByte := data[0]
+	rest := data[1:]
+
+	switch formatByte {
+	case vaultVersion:
+		return parsePlainVaultHeader(rest)
+	case vaultVersionFEC:
+		headerBlocks := rawHeaderV2Size / fecHeaderBlockData
+		protectedLen := headerBlocks * (fecHeaderBlockData + fecHeaderBlockParity)
+		if len(rest) < protectedLen {
+			return vaultHeader{}, nil, errors.New("invalid vault: too short")
+		}
+		rawHeader, _, err := fecDecodeHeader(rest[:protectedLen])
+		if err != nil {
+			return vaultHeader{}, nil, err
+		}
+		hdr, err := parseRawHeaderV2(rawHeader)
+		if err != nil {
+			return vaultHeader{}, nil, err
+		}
+		return hdr, rest[protectedLen:], nil
+	default:
+		return vaultHeader{}, nil, fmt.Errorf("unsupported vault version %d", formatByte)
+	}
+}
+
+// marshalPlainHeader builds the unprotected header used when --fec is
+// off: magic || version || argonParams || salt || flags ||
+// keyfileFingerprint.
+func marshalPlainHeader(params argonParams, salt [saltSize]byte, f flags, keyfileFingerprint [keyfileFingerprintSize]byte) []byte {
+	b := make([]byte, 0, plainHeaderSize)
+	b = append(b, vaultMagic...)
+	b = append(b, vaultVersion)
+	b = append(b, params.marshal()...)
+	b = append(b, salt[:]...)
+	b = append(b, byte(f))
+	b = append(b, keyfileFingerprint[:]...)
+	return b
+}
+
+func parsePlainVaultHeader(data []byte) (vaultHeader, []byte, error) {
+	if len(data) < len(vaultMagic)+1 {
+		return vaultHeader{}, nil, errors.New("invalid vault: too short")
+	}
+	if string(data[:len(vaultMagic)]) != vaultMagic {
+		return vaultHeader{}, nil, errors.New("invalid vault: bad magic")
+	}
+	pos := len(vaultMagic)
+	version := data[pos]
+	pos++
+	if version != vaultVersion {
+		return vaultHeader{}, nil, fmt.Errorf("unsupported vault version %d", version)
+	}
+
+	paramsLen := 1 + 4 + 4 + 1
+	if len(data) < pos+paramsLen+saltSize+1+keyfileFingerprintSize {
+		return vaultHeader{}, nil, errors.New("invalid vault: truncated header")
+	}
+	params, err := parseArgonParams(data[pos : pos+paramsLen])
+	if err != nil {
+		return vaultHeader{}, nil, err
+	}
+	pos += paramsLen
+
+	var hdr vaultHeader
+	hdr.params = params
+	copy(hdr.salt[:], data[pos:pos+saltSize])
+	pos += saltSize
+	hdr.flags = flags(data[pos])
+	pos++
+	copy(hdr.keyfileFingerprint[:], data[pos:pos+keyfileFingerprintSize])
+	pos += keyfileFingerprintSize
+
+	return hdr, data[pos:], nil
+}
+
+func loadStore(path string, password []byte, keyfileDigest *[keyfileFingerprintSize]byte, fix bool) (SecretStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return make(SecretStore), nil
+		}
+		return nil, err
+	}
+	return decryptStore(data, password, keyfileDigest, fix)
+}
+
+func saveStore(path string, store SecretStore, password []byte, params argonParams, f flags, keyfileDigest *[keyfileFingerprintSize]byte) error {
+	data, err := encryptStore(store, password, params, f, keyfileDigest)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// peekVaultHeader reads just the header off an existing vault file without
+// decrypting it, so a rekey-style command can see what params/flags it
+// already carries before deciding whether to override them. It returns a
+// nil header (not an error) if the vault doesn't exist yet.
+func peekVaultHeader(path string) (*vaultHeader, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	hdr, _, err := parseVaultHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	return &hdr, nil
+}
+
+func vaultExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// promptNewPassword prompts for a master password twice and requires the
+// two entries to match before returning it.
+func promptNewPassword() (*SecretBytes, error) {
+	fmt.Print("Enter new master password: ")
+	pw1, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Print("Confirm master password: ")
+	pw2, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		return nil, err
+	}
+	confirm := NewSecretBytes(pw2)
+	defer confirm.Zero()
+	if subtle.ConstantTimeCompare(pw1, pw2) != 1 {
+		NewSecretBytes(pw1).Zero()
+		return nil, errors.New("passwords did not match")
+	}
+	return NewSecretBytes(pw1), nil
+}
+
+func promptExistingPassword() (*SecretBytes, error) {
+	fmt.Print("Enter master password: ")
+	pw, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		return nil, err
+	}
+	return NewSecretBytes(pw), nil
+}